@@ -0,0 +1,78 @@
+package common
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/sha1"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// maxChunkSize is the largest payload one AEAD chunk may carry: the chunk
+// length field is 14 bits per the shadowsocks AEAD spec.
+const maxChunkSize = 0x3FFF
+
+var (
+	errShortSalt   = errors.New("shadowsocks: truncated salt")
+	errChunkTooBig = errors.New("shadowsocks: chunk length exceeds maximum")
+)
+
+// cipherSpec describes one supported AEAD cipher: its key/salt sizes and
+// how to build the cipher.AEAD from a derived per-session subkey.
+type cipherSpec struct {
+	keySize  int
+	saltSize int
+	aead     func(key []byte) (cipher.AEAD, error)
+}
+
+var cipherSpecs = map[string]cipherSpec{
+	"aes-128-gcm":            {keySize: 16, saltSize: 16, aead: newGCM},
+	"aes-256-gcm":            {keySize: 32, saltSize: 32, aead: newGCM},
+	"chacha20-ietf-poly1305": {keySize: 32, saltSize: 32, aead: chacha20poly1305.New},
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// kdf derives the master key from the configured password the same way
+// original shadowsocks does (OpenSSL's EVP_BytesToKey): repeated MD5 of the
+// previous digest concatenated with the password, truncated to keySize.
+func kdf(password string, keySize int) []byte {
+	var out, prev []byte
+	for len(out) < keySize {
+		h := md5.New()
+		h.Write(prev)
+		h.Write([]byte(password))
+		prev = h.Sum(nil)
+		out = append(out, prev...)
+	}
+	return out[:keySize]
+}
+
+// subkey derives the per-session AEAD key from the master key and a
+// per-session salt, per the shadowsocks AEAD spec (HKDF-SHA1, info
+// "ss-subkey").
+func subkey(masterKey, salt []byte, keySize int) []byte {
+	out := make([]byte, keySize)
+	io.ReadFull(hkdf.New(sha1.New, masterKey, salt, []byte("ss-subkey")), out)
+	return out
+}
+
+// incNonce increments nonce as a little-endian counter, in place.
+func incNonce(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
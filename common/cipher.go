@@ -0,0 +1,29 @@
+package common
+
+import "errors"
+
+var errCipherMethod = errors.New("unsupported cipher method")
+
+// Cipher holds the AEAD parameters and derived master key used to encrypt
+// and decrypt the shadowsocks stream for one server; the actual chunk
+// framing lives in aead.go.
+type Cipher struct {
+	method string
+	key    []byte
+	spec   cipherSpec
+}
+
+// NewCipher builds a Cipher from a server's configured method/password,
+// deriving the AEAD master key from the password.
+func NewCipher(srv Server) *Cipher {
+	spec := cipherSpecs[srv.Method]
+	return &Cipher{method: srv.Method, key: kdf(srv.Password, spec.keySize), spec: spec}
+}
+
+// CheckCipherMethod rejects unknown cipher names before we ever dial.
+func CheckCipherMethod(method string) error {
+	if _, ok := cipherSpecs[method]; !ok {
+		return errCipherMethod
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package common
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// Server describes one shadowsocks upstream.
+type Server struct {
+	Server   string `json:"server"`
+	Port     int    `json:"server_port"`
+	Password string `json:"password"`
+	Method   string `json:"method"`
+}
+
+// User is one SOCKS5 username/password credential accepted by the local
+// client's auth negotiation.
+type User struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+// Config is the parsed contents of config.json.
+type Config struct {
+	Servers        []Server         `json:"servers"`
+	LocalPort      int              `json:"local_port"`
+	Users          []User           `json:"users"`
+	Strategy       string           `json:"strategy"`
+	ManagerAddress string           `json:"manager_address"`
+	Transport      *TransportConfig `json:"transport"`
+}
+
+// ParseConfig reads and decodes the config file at path.
+func ParseConfig(path string) (config *Config, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	config = &Config{}
+	if err = json.NewDecoder(file).Decode(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
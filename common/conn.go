@@ -0,0 +1,88 @@
+package common
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+const readTimeout = 300 * time.Second
+
+// Conn is a net.Conn to a shadowsocks server with AEAD encryption/
+// decryption applied transparently to Read/Write (see aead.go/stream.go).
+// Each direction carries its own random salt and is encrypted lazily, on
+// its first Read or Write.
+type Conn struct {
+	net.Conn
+	cipher *Cipher
+	writer *aeadWriter
+	reader *aeadReader
+}
+
+// SetReadTimeout bounds how long a SOCKS5 handshake/request read may block.
+func SetReadTimeout(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
+}
+
+// Write encrypts p into the AEAD chunk format and writes it to the
+// underlying connection, writing this direction's salt first if this is
+// the first Write.
+func (c *Conn) Write(p []byte) (int, error) {
+	if c.writer == nil {
+		w, err := newAEADWriter(c.Conn, c.cipher)
+		if err != nil {
+			return 0, err
+		}
+		c.writer = w
+	}
+	return c.writer.Write(p)
+}
+
+// Read reads and decrypts AEAD chunks from the underlying connection,
+// reading this direction's salt first if this is the first Read.
+func (c *Conn) Read(p []byte) (int, error) {
+	if c.reader == nil {
+		c.reader = newAEADReader(c.Conn, c.cipher)
+	}
+	return c.reader.Read(p)
+}
+
+// DialWithRawAddr connects to a shadowsocks server through transport and
+// sends rawaddr (the raw SOCKS5 address) as the first encrypted payload.
+// A nil transport dials a plain TCP connection.
+func DialWithRawAddr(rawaddr []byte, server string, cipher *Cipher, transport Transport) (c *Conn, err error) {
+	if transport == nil {
+		transport = PlainTransport{}
+	}
+	conn, err := transport.Dial("tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	c = &Conn{Conn: conn, cipher: cipher}
+	if _, err = c.Write(rawaddr); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// PipeThenClose copies from src to dst until a read from src returns an
+// error (EOF included) or a write to dst fails, then closes dst. src is
+// left open.
+func PipeThenClose(src io.Reader, dst io.Closer) {
+	defer dst.Close()
+	buf := make([]byte, 4096)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if w, ok := dst.(io.Writer); ok {
+				if _, werr := w.Write(buf[:n]); werr != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+}
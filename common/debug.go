@@ -0,0 +1,23 @@
+package common
+
+import "log"
+
+// DebugLog is a bool that doubles as a conditional logger.
+type DebugLog bool
+
+func (d DebugLog) Println(v ...interface{}) {
+	if d {
+		log.Println(v...)
+	}
+}
+
+func (d DebugLog) Printf(format string, v ...interface{}) {
+	if d {
+		log.Printf(format, v...)
+	}
+}
+
+// SetDebug is kept for symmetry with DebugLog; callers typically just
+// assign the flag.BoolVar target directly.
+func SetDebug(d DebugLog) {
+}
@@ -0,0 +1,135 @@
+package common
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+)
+
+// aeadWriter encrypts a byte stream into the shadowsocks AEAD wire format:
+// a random salt written once, then a sequence of chunks, each a length
+// field and a payload field independently AEAD-sealed with a nonce that
+// increments after every seal.
+type aeadWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	nonce []byte
+}
+
+func newAEADWriter(w io.Writer, c *Cipher) (*aeadWriter, error) {
+	salt := make([]byte, c.spec.saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := c.spec.aead(subkey(c.key, salt, c.spec.keySize))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(salt); err != nil {
+		return nil, err
+	}
+	return &aeadWriter{w: w, aead: aead, nonce: make([]byte, aead.NonceSize())}, nil
+}
+
+func (e *aeadWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > maxChunkSize {
+			n = maxChunkSize
+		}
+		if err := e.writeChunk(p[:n]); err != nil {
+			return written, err
+		}
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *aeadWriter) writeChunk(payload []byte) error {
+	var lenBuf [2]byte
+	binary.BigEndian.PutUint16(lenBuf[:], uint16(len(payload)))
+	sealedLen := e.aead.Seal(nil, e.nonce, lenBuf[:], nil)
+	incNonce(e.nonce)
+	sealedPayload := e.aead.Seal(nil, e.nonce, payload, nil)
+	incNonce(e.nonce)
+	if _, err := e.w.Write(sealedLen); err != nil {
+		return err
+	}
+	_, err := e.w.Write(sealedPayload)
+	return err
+}
+
+// aeadReader is the read side of aeadWriter: it lazily reads the peer's
+// salt on the first Read, then decrypts chunks, buffering any plaintext
+// the caller's slice didn't have room for yet.
+type aeadReader struct {
+	r      io.Reader
+	cipher *Cipher
+	aead   cipher.AEAD
+	nonce  []byte
+	buf    []byte
+}
+
+func newAEADReader(r io.Reader, c *Cipher) *aeadReader {
+	return &aeadReader{r: r, cipher: c}
+}
+
+func (d *aeadReader) Read(p []byte) (int, error) {
+	if d.aead == nil {
+		if err := d.init(); err != nil {
+			return 0, err
+		}
+	}
+	if len(d.buf) == 0 {
+		if err := d.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+func (d *aeadReader) init() error {
+	salt := make([]byte, d.cipher.spec.saltSize)
+	if _, err := io.ReadFull(d.r, salt); err != nil {
+		return err
+	}
+	aead, err := d.cipher.spec.aead(subkey(d.cipher.key, salt, d.cipher.spec.keySize))
+	if err != nil {
+		return err
+	}
+	d.aead = aead
+	d.nonce = make([]byte, aead.NonceSize())
+	return nil
+}
+
+func (d *aeadReader) readChunk() error {
+	lenSealed := make([]byte, 2+d.aead.Overhead())
+	if _, err := io.ReadFull(d.r, lenSealed); err != nil {
+		return err
+	}
+	lenBuf, err := d.aead.Open(nil, d.nonce, lenSealed, nil)
+	if err != nil {
+		return err
+	}
+	incNonce(d.nonce)
+	size := binary.BigEndian.Uint16(lenBuf)
+	if int(size) > maxChunkSize {
+		return errChunkTooBig
+	}
+	payloadSealed := make([]byte, int(size)+d.aead.Overhead())
+	if _, err := io.ReadFull(d.r, payloadSealed); err != nil {
+		return err
+	}
+	payload, err := d.aead.Open(nil, d.nonce, payloadSealed, nil)
+	if err != nil {
+		return err
+	}
+	incNonce(d.nonce)
+	d.buf = payload
+	return nil
+}
@@ -0,0 +1,185 @@
+package common
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+var (
+	errPinnedCertMismatch = errors.New("transport: server certificate does not match pinned fingerprint")
+	errWebSocketUpgrade   = errors.New("transport: websocket upgrade failed")
+)
+
+// Transport dials the outer connection that the encrypted shadowsocks
+// stream rides inside of, letting a deployment blend in with ordinary
+// HTTPS traffic in DPI environments.
+type Transport interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// TransportConfig is the "transport" block of config.json.
+type TransportConfig struct {
+	Type             string `json:"type"` // "plain" (default), "tls", "ws"
+	Path             string `json:"path"`
+	Host             string `json:"host"`
+	TLS              bool   `json:"tls"`
+	PinnedCertSHA256 string `json:"pinned_cert_sha256"`
+}
+
+// BuildTransport builds the Transport described by cfg, defaulting to
+// PlainTransport when cfg is nil or cfg.Type is empty.
+func BuildTransport(cfg *TransportConfig) (Transport, error) {
+	if cfg == nil || cfg.Type == "" || cfg.Type == "plain" {
+		return PlainTransport{}, nil
+	}
+	switch cfg.Type {
+	case "tls":
+		return TLSTransport{ServerName: cfg.Host, PinnedCertSHA256: cfg.PinnedCertSHA256}, nil
+	case "ws":
+		return WebSocketTransport{Path: cfg.Path, Host: cfg.Host, TLS: cfg.TLS, PinnedCertSHA256: cfg.PinnedCertSHA256}, nil
+	default:
+		return nil, fmt.Errorf("transport: unknown type %q", cfg.Type)
+	}
+}
+
+// PlainTransport is a plain TCP dial: the current, unwrapped behavior.
+type PlainTransport struct{}
+
+func (PlainTransport) Dial(network, addr string) (net.Conn, error) {
+	return net.Dial(network, addr)
+}
+
+// TLSTransport wraps the connection in TLS, verifying against ServerName
+// (SNI) and, if set, a pinned SHA-256 fingerprint that must match at least
+// one certificate the server presents (leaf or intermediate).
+type TLSTransport struct {
+	ServerName       string
+	PinnedCertSHA256 string
+}
+
+func (t TLSTransport) Dial(network, addr string) (net.Conn, error) {
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: t.ServerName})
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if t.PinnedCertSHA256 != "" {
+		if err := verifyPinnedCert(tlsConn, t.PinnedCertSHA256); err != nil {
+			tlsConn.Close()
+			return nil, err
+		}
+	}
+	return tlsConn, nil
+}
+
+func verifyPinnedCert(conn *tls.Conn, pinnedHex string) error {
+	for _, cert := range conn.ConnectionState().PeerCertificates {
+		sum := sha256.Sum256(cert.Raw)
+		if hex.EncodeToString(sum[:]) == pinnedHex {
+			return nil
+		}
+	}
+	return errPinnedCertMismatch
+}
+
+// WebSocketTransport performs an HTTP/1.1 WebSocket Upgrade handshake to
+// Path, after which the shadowsocks stream is carried over the raw
+// net.Conn as plain bytes; no WebSocket frames are built or parsed.
+type WebSocketTransport struct {
+	Path             string
+	Host             string
+	TLS              bool
+	PinnedCertSHA256 string
+}
+
+func (t WebSocketTransport) Dial(network, addr string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if t.TLS {
+		conn, err = TLSTransport{ServerName: t.Host, PinnedCertSHA256: t.PinnedCertSHA256}.Dial(network, addr)
+	} else {
+		conn, err = net.Dial(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	wsConn, err := wsUpgrade(conn, t.Host, t.Path)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return wsConn, nil
+}
+
+// websocketAcceptGUID is RFC 6455's fixed GUID, concatenated with the
+// client's Sec-WebSocket-Key before SHA-1 hashing to derive the expected
+// Sec-WebSocket-Accept value.
+const websocketAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsUpgrade performs a client-side HTTP/1.1 Upgrade to WebSocket and
+// checks the server's Sec-WebSocket-Accept; it does not add WebSocket
+// framing, so what is written after the handshake goes out unframed. It
+// returns conn wrapped so that any bytes the response parser already
+// buffered past the headers (e.g. a server that coalesces the 101 reply
+// with the first bytes of the tunnel) are still delivered to the caller
+// instead of being dropped.
+func wsUpgrade(conn net.Conn, host, path string) (net.Conn, error) {
+	keyBytes := make([]byte, 16)
+	if _, err := rand.Read(keyBytes); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(keyBytes)
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+host+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, errWebSocketUpgrade
+	}
+	sum := sha1.Sum([]byte(key + websocketAcceptGUID))
+	want := base64.StdEncoding.EncodeToString(sum[:])
+	if resp.Header.Get("Sec-WebSocket-Accept") != want {
+		return nil, errWebSocketUpgrade
+	}
+	return &bufferedConn{Conn: conn, r: br}, nil
+}
+
+// bufferedConn serves Read from a bufio.Reader that may already hold bytes
+// read past the Upgrade response headers, falling through to the
+// underlying net.Conn once that buffer is drained.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
@@ -0,0 +1,85 @@
+package common
+
+import (
+	"crypto/rand"
+	"net"
+)
+
+// PacketConn is a local UDP socket used to relay one client's UDP ASSOCIATE
+// session.
+type PacketConn struct {
+	net.PacketConn
+}
+
+// ListenPacket opens a local UDP socket on addr (typically ":0", letting the
+// OS pick a port) for a client's UDP ASSOCIATE session.
+func ListenPacket(addr string) (*PacketConn, error) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &PacketConn{PacketConn: pc}, nil
+}
+
+// UDPConn is a UDP "connection" to a shadowsocks server carrying one NAT
+// entry's datagrams. Unlike the TCP Conn, each datagram is self-contained:
+// every Write seals one packet behind its own random salt, and every Read
+// decrypts one packet using the salt it carries.
+type UDPConn struct {
+	net.Conn
+	cipher *Cipher
+}
+
+// DialUDPWithRawAddr opens a UDP socket to a shadowsocks server for
+// relaying datagrams. It sends nothing itself: the caller puts the raw
+// destination address in front of each datagram it writes.
+func DialUDPWithRawAddr(server string, cipher *Cipher) (*UDPConn, error) {
+	conn, err := net.Dial("udp", server)
+	if err != nil {
+		return nil, err
+	}
+	return &UDPConn{Conn: conn, cipher: cipher}, nil
+}
+
+// Write encrypts p as one shadowsocks AEAD UDP packet: salt || seal(p).
+func (c *UDPConn) Write(p []byte) (int, error) {
+	spec := c.cipher.spec
+	salt := make([]byte, spec.saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return 0, err
+	}
+	aead, err := spec.aead(subkey(c.cipher.key, salt, spec.keySize))
+	if err != nil {
+		return 0, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	sealed := aead.Seal(salt, nonce, p, nil)
+	if _, err := c.Conn.Write(sealed); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Read decrypts one shadowsocks AEAD UDP packet into p.
+func (c *UDPConn) Read(p []byte) (int, error) {
+	buf := make([]byte, 65536)
+	n, err := c.Conn.Read(buf)
+	if err != nil {
+		return 0, err
+	}
+	spec := c.cipher.spec
+	if n < spec.saltSize {
+		return 0, errShortSalt
+	}
+	salt := buf[:spec.saltSize]
+	aead, err := spec.aead(subkey(c.cipher.key, salt, spec.keySize))
+	if err != nil {
+		return 0, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	plain, err := aead.Open(nil, nonce, buf[spec.saltSize:n], nil)
+	if err != nil {
+		return 0, err
+	}
+	return copy(p, plain), nil
+}
@@ -0,0 +1,10 @@
+package common
+
+import "fmt"
+
+const version = "1.0.0"
+
+// PrintVersion prints the build version to stdout for the -v flag.
+func PrintVersion() {
+	fmt.Println("go-shadowsocks", version)
+}
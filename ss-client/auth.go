@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"io"
+
+	comm "github.com/go-shadowsocks/common"
+)
+
+var (
+	errAuthVer    = errors.New("socks auth sub-negotiation version not supported")
+	errBadCreds   = errors.New("socks auth bad username or password")
+	errNoAuthList = errors.New("socks client offered no acceptable auth method")
+)
+
+const (
+	authMethodNoAuth   = 0x00
+	authMethodUserPass = 0x02
+	authMethodNoAccept = 0xff
+
+	authUserPassVer = 0x01
+)
+
+// AuthContext carries the identity an Authenticator established during the
+// SOCKS5 sub-negotiation, so later stages (ACLs, per-user stats) can key off
+// it. User is empty for NoAuth.
+type AuthContext struct {
+	User string
+}
+
+// Authenticator implements one SOCKS5 auth method (RFC 1928 section 3).
+// GetCode reports the method byte it advertises in the method-selection
+// reply; Authenticate runs the method's sub-negotiation and returns the
+// resulting identity.
+type Authenticator interface {
+	GetCode() byte
+	Authenticate(r io.Reader, w io.Writer) (*AuthContext, error)
+}
+
+// NoAuth is the "no authentication required" method (0x00).
+type NoAuth struct{}
+
+func (NoAuth) GetCode() byte { return authMethodNoAuth }
+
+func (NoAuth) Authenticate(r io.Reader, w io.Writer) (*AuthContext, error) {
+	return &AuthContext{}, nil
+}
+
+// UserPass implements RFC 1929 username/password authentication (0x02).
+type UserPass struct {
+	creds map[string]string
+}
+
+// NewUserPass builds a UserPass authenticator from configured credentials.
+func NewUserPass(users []comm.User) *UserPass {
+	creds := make(map[string]string, len(users))
+	for _, u := range users {
+		creds[u.User] = u.Password
+	}
+	return &UserPass{creds: creds}
+}
+
+func (UserPass) GetCode() byte { return authMethodUserPass }
+
+// Authenticate reads the RFC 1929 sub-negotiation packet:
+// VER(1) ULEN(1) UNAME(ULEN) PLEN(1) PASSWD(PLEN)
+// and replies VER(1) STATUS(1). On bad credentials it writes the failure
+// status and returns errBadCreds; closing the connection is left to the
+// caller.
+func (u *UserPass) Authenticate(r io.Reader, w io.Writer) (*AuthContext, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != authUserPassVer {
+		return nil, errAuthVer
+	}
+	uname := make([]byte, header[1])
+	if _, err := io.ReadFull(r, uname); err != nil {
+		return nil, err
+	}
+	plenBuf := make([]byte, 1)
+	if _, err := io.ReadFull(r, plenBuf); err != nil {
+		return nil, err
+	}
+	passwd := make([]byte, plenBuf[0])
+	if _, err := io.ReadFull(r, passwd); err != nil {
+		return nil, err
+	}
+
+	user, pass := string(uname), string(passwd)
+	if want, ok := u.creds[user]; !ok || want != pass {
+		w.Write([]byte{authUserPassVer, 0x01})
+		return nil, errBadCreds
+	}
+	if _, err := w.Write([]byte{authUserPassVer, 0x00}); err != nil {
+		return nil, err
+	}
+	return &AuthContext{User: user}, nil
+}
+
+// selectAuthenticator picks the configured Authenticator whose code is
+// present in methods, preferring UserPass over NoAuth when both are
+// offered and configured so credentials are enforced whenever available.
+func selectAuthenticator(authenticators []Authenticator, methods []byte) Authenticator {
+	offered := make(map[byte]bool, len(methods))
+	for _, m := range methods {
+		offered[m] = true
+	}
+	var best Authenticator
+	for _, a := range authenticators {
+		if offered[a.GetCode()] {
+			if best == nil || a.GetCode() > best.GetCode() {
+				best = a
+			}
+		}
+	}
+	return best
+}
@@ -0,0 +1,60 @@
+package main
+
+import "testing"
+
+func TestSelectAuthenticator(t *testing.T) {
+	userPass := NewUserPass(nil)
+
+	cases := []struct {
+		name           string
+		authenticators []Authenticator
+		methods        []byte
+		want           Authenticator
+	}{
+		{
+			name:           "no candidates configured",
+			authenticators: nil,
+			methods:        []byte{authMethodNoAuth},
+			want:           nil,
+		},
+		{
+			name:           "client offers nothing we accept",
+			authenticators: []Authenticator{NoAuth{}},
+			methods:        []byte{authMethodUserPass},
+			want:           nil,
+		},
+		{
+			name:           "only NoAuth configured",
+			authenticators: []Authenticator{NoAuth{}},
+			methods:        []byte{authMethodNoAuth, authMethodUserPass},
+			want:           NoAuth{},
+		},
+		{
+			name:           "only UserPass configured, client omits it",
+			authenticators: []Authenticator{userPass},
+			methods:        []byte{authMethodNoAuth},
+			want:           nil,
+		},
+		{
+			name:           "only UserPass configured, client offers it",
+			authenticators: []Authenticator{userPass},
+			methods:        []byte{authMethodNoAuth, authMethodUserPass},
+			want:           userPass,
+		},
+		{
+			name:           "both configured, prefers UserPass",
+			authenticators: []Authenticator{userPass, NoAuth{}},
+			methods:        []byte{authMethodNoAuth, authMethodUserPass},
+			want:           userPass,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := selectAuthenticator(c.authenticators, c.methods)
+			if got != c.want {
+				t.Errorf("selectAuthenticator() = %v, want %v", got, c.want)
+			}
+		})
+	}
+}
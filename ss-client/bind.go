@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	comm "github.com/go-shadowsocks/common"
+)
+
+const bindAcceptTimeout = 60 * time.Second
+
+// handleBind implements the SOCKS5 BIND command (RFC 1928 section 4),
+// used by active-mode FTP: we listen locally, tell the client where, wait
+// for the single inbound peer the client's protocol expects, tell the
+// client who connected, then bridge peer<->remote through the shadowsocks
+// tunnel like a normal CONNECT.
+func handleBind(conn net.Conn, rawaddr []byte, addr string) {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		debug.Println("bind: listen failed:", err)
+		sendReply(conn, socksRepCmdNotSupport, nil)
+		return
+	}
+	defer ln.Close()
+
+	if err := sendReply(conn, socksRepSucceeded, ln.Addr().(*net.TCPAddr)); err != nil {
+		debug.Println("bind: send first reply:", err)
+		return
+	}
+
+	ln.(*net.TCPListener).SetDeadline(time.Now().Add(bindAcceptTimeout))
+	peer, err := ln.Accept()
+	if err != nil {
+		debug.Println("bind: accept failed:", err)
+		return
+	}
+	defer peer.Close()
+
+	if err := sendReply(conn, socksRepSucceeded, peer.RemoteAddr().(*net.TCPAddr)); err != nil {
+		debug.Println("bind: send second reply:", err)
+		return
+	}
+
+	remote, idx, err := createServerConn(rawaddr, addr)
+	if err != nil {
+		debug.Println("bind: connect to remote error:", err)
+		return
+	}
+	defer remote.Close()
+
+	counted := &countingConn{Conn: remote, pool: server.pool, idx: idx}
+	go comm.PipeThenClose(peer, counted)
+	comm.PipeThenClose(counted, peer)
+	debug.Println("bind: closed connection to", addr)
+}
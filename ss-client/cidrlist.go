@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/netip"
+	"sort"
+)
+
+// cidrList is a set of IP prefixes kept sorted by starting address so a
+// binary search can skip every prefix that starts after the address being
+// tested; see Contains for the scan over the rest.
+type cidrList struct {
+	prefixes []netip.Prefix
+}
+
+func newCIDRList(cidrs []string) (*cidrList, error) {
+	l := &cidrList{}
+	for _, c := range cidrs {
+		p, err := netip.ParsePrefix(c)
+		if err != nil {
+			return nil, err
+		}
+		l.prefixes = append(l.prefixes, p)
+	}
+	l.sort()
+	return l, nil
+}
+
+func (l *cidrList) sort() {
+	sort.Slice(l.prefixes, func(i, j int) bool {
+		return l.prefixes[i].Addr().Compare(l.prefixes[j].Addr()) < 0
+	})
+}
+
+// Contains reports whether ip falls in any prefix. Prefixes are sorted by
+// starting address, so we binary-search for the last one starting at or
+// before ip, then scan backwards: a broader prefix (e.g. 10.0.0.0/8) can
+// start well before a narrower one that doesn't contain ip (e.g. a sibling
+// 10.N.0.0/24), so the scan must not stop at the first miss — it runs all
+// the way back to index 0.
+func (l *cidrList) Contains(ip netip.Addr) bool {
+	idx := sort.Search(len(l.prefixes), func(i int) bool {
+		return l.prefixes[i].Addr().Compare(ip) > 0
+	})
+	for i := idx - 1; i >= 0; i-- {
+		if l.prefixes[i].Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
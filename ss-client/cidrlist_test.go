@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestCIDRListContains(t *testing.T) {
+	l, err := newCIDRList([]string{
+		"10.0.0.0/8",
+		"10.1.0.0/24",
+		"10.2.0.0/24",
+		"10.3.0.0/24",
+		"10.4.0.0/24",
+		"10.5.0.0/24",
+		"10.6.0.0/24",
+		"192.168.1.0/24",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.250.0.5", true},  // only in the broad /8, behind six narrower siblings
+		{"10.1.0.5", true},    // in a narrow /24
+		{"192.168.1.5", true}, // in an unrelated prefix
+		{"172.16.0.1", false}, // in no prefix at all
+	}
+
+	for _, c := range cases {
+		addr := netip.MustParseAddr(c.ip)
+		if got := l.Contains(addr); got != c.want {
+			t.Errorf("Contains(%s) = %v, want %v", c.ip, got, c.want)
+		}
+	}
+}
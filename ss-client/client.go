@@ -16,49 +16,70 @@ import (
 var (
 	errAddrType      = errors.New("socks addr type not supported")
 	errVer           = errors.New("socks version not supported")
-	errMethod        = errors.New("socks only support 1 method now")
 	errAuthExtraData = errors.New("socks authentication get extra data")
 	errReqExtraData  = errors.New("socks request get extra data")
 	errCmd           = errors.New("socks command not supported")
 )
 
 const (
-	socksVer5       = 5
-	socksCmdConnect = 1
+	socksVer5            = 5
+	socksCmdConnect      = 1
+	socksCmdBind         = 2
+	socksCmdUDPAssociate = 3
+
+	socksRepSucceeded      = 0x00
+	socksRepCmdNotSupport  = 0x07
+	socksRepRuleNotAllowed = 0x02
+
+	typeIPv4 = 1
+	typeDm   = 3
+	typeIPv6 = 4
 )
 
 var debug comm.DebugLog
 
-//handshake:
-func handshake(conn net.Conn) (err error) {
+//handshake: negotiate the auth method, then run its sub-negotiation
+func handshake(conn net.Conn) (authCtx *AuthContext, err error) {
 	debug.Println("start handshake...")
 	buf := make([]byte, 258)
 	comm.SetReadTimeout(conn)
 	var n int
 	if n, err = io.ReadAtLeast(conn, buf, 2); err != nil {
-		return err
+		return nil, err
 	}
 	ver := buf[0]
 	if ver != socksVer5 {
-		return errVer
+		return nil, errVer
 	}
 	nmethod := int(buf[1])
 	msglen := nmethod + 2
 	if n == msglen { //general handshake
 	} else if n < msglen { //need password & username
 		if _, err = io.ReadFull(conn, buf); err != nil {
-			return
+			return nil, err
 		}
 	} else {
-		return errAuthExtraData
+		return nil, errAuthExtraData
+	}
+	methods := buf[2:msglen]
+
+	auth := selectAuthenticator(server.authenticators, methods)
+	if auth == nil {
+		conn.Write([]byte{socksVer5, authMethodNoAccept})
+		return nil, errNoAuthList
+	}
+	if _, err = conn.Write([]byte{socksVer5, auth.GetCode()}); err != nil {
+		return nil, err
+	}
+	if authCtx, err = auth.Authenticate(conn, conn); err != nil {
+		return nil, err
 	}
-	_, err = conn.Write([]byte{5, 0})
 	debug.Println("finished handshake...")
-	return
+	return authCtx, nil
 }
 
 //getRequest: unpack request
-func getRequest(conn net.Conn) (rawaddr []byte, host string, err error) {
+func getRequest(conn net.Conn) (cmd byte, rawaddr []byte, host string, err error) {
 	const (
 		idVer   = 0
 		idCmd   = 1
@@ -67,10 +88,6 @@ func getRequest(conn net.Conn) (rawaddr []byte, host string, err error) {
 		idDmLen = 4
 		idDm0   = 5
 
-		typeIPv4 = 1
-		typeDm   = 3
-		typeIPv6 = 4
-
 		lenIPv4   = 3 + 1 + net.IPv4len + 2 // 3(ver+cmd+rsv) + 1addrType + ipv4 + 2port
 		lenIPv6   = 3 + 1 + net.IPv6len + 2 // 3(ver+cmd+rsv) + 1addrType + ipv6 + 2port
 		lenDmBase = 3 + 1 + 1 + 2           // 3 + 1addrType + 1addrLen + 2port, plus addrLen
@@ -85,7 +102,10 @@ func getRequest(conn net.Conn) (rawaddr []byte, host string, err error) {
 		err = errVer
 		return
 	}
-	if buf[idCmd] != socksCmdConnect {
+	cmd = buf[idCmd]
+	switch cmd {
+	case socksCmdConnect, socksCmdBind, socksCmdUDPAssociate:
+	default:
 		err = errCmd
 		return
 	}
@@ -114,29 +134,33 @@ func getRequest(conn net.Conn) (rawaddr []byte, host string, err error) {
 		return
 	}
 	rawaddr = buf[idType:reqLen]
-	if debug {
-		switch buf[idType] {
-		case typeIPv4:
-			host = net.IP(buf[idIP0 : idIP0+net.IPv4len]).String()
-		case typeDm:
-			host = net.IP(buf[idDm0 : idDm0+buf[idDmLen]]).String()
-		case typeIPv6:
-			host = net.IP(buf[idIP0 : idIP0+net.IPv6len]).String()
-		}
-		port := binary.BigEndian.Uint16(buf[reqLen-2 : reqLen])
-		host = net.JoinHostPort(host, strconv.Itoa(int(port)))
-		debug.Println("visit host:", host)
+	switch buf[idType] {
+	case typeIPv4:
+		host = net.IP(buf[idIP0 : idIP0+net.IPv4len]).String()
+	case typeDm:
+		host = string(buf[idDm0 : idDm0+buf[idDmLen]])
+	case typeIPv6:
+		host = net.IP(buf[idIP0 : idIP0+net.IPv6len]).String()
 	}
+	port := binary.BigEndian.Uint16(buf[reqLen-2 : reqLen])
+	host = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	debug.Println("visit host:", host)
 	return
 }
 
-//createServerConn: connect to remote
-func createServerConn(rawaddr []byte, addr string) (remote *comm.Conn, err error) {
-	serverport := server.srvCipher.srv.Server + ":" + strconv.Itoa(server.srvCipher.srv.Port)
-	remote, err = comm.DialWithRawAddr(rawaddr, serverport, server.srvCipher.cipher)
+//createServerConn: connect to remote, picking a server from the pool
+func createServerConn(rawaddr []byte, addr string) (remote *comm.Conn, idx int, err error) {
+	sc, idx, err := server.pool.Pick()
+	if err != nil {
+		log.Println("error picking shadowsocks server:", err)
+		return nil, idx, err
+	}
+	serverport := sc.srv.Server + ":" + strconv.Itoa(sc.srv.Port)
+	remote, err = comm.DialWithRawAddr(rawaddr, serverport, sc.cipher, server.transport)
+	server.pool.RecordResult(idx, err)
 	if err != nil {
 		log.Println("error connecting to shadowsocks server:", err)
-		return nil, err
+		return nil, idx, err
 	}
 	debug.Printf("connect to remote:%s success", serverport)
 	return
@@ -144,40 +168,82 @@ func createServerConn(rawaddr []byte, addr string) (remote *comm.Conn, err error
 
 func handleConnection(conn net.Conn) {
 	debug.Printf("socks connect from %s\n", conn.RemoteAddr().String())
-	closed := false
-	defer func() {
-		if !closed {
-			conn.Close()
-		}
-	}()
+	defer conn.Close()
 
-	if err := handshake(conn); err != nil {
+	authCtx, err := handshake(conn)
+	if err != nil {
 		debug.Printf("handshake: %s", err)
 		return
 	}
-	rawaddr, addr, err := getRequest(conn)
+	if authCtx.User != "" {
+		debug.Printf("authenticated as %s\n", authCtx.User)
+	}
+	cmd, rawaddr, addr, err := getRequest(conn)
 	if err != nil {
 		debug.Printf("error get request: %s\n", err)
 		return
 	}
-	_, err = conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x08, 0x43})
-	if err != nil {
+
+	switch cmd {
+	case socksCmdConnect:
+		switch decideRoute(rawaddr, addr) {
+		case routeDirect:
+			handleDirect(conn, addr)
+		case routeReject:
+			sendReply(conn, socksRepRuleNotAllowed, nil)
+		default:
+			handleConnect(conn, rawaddr, addr)
+		}
+	case socksCmdBind:
+		handleBind(conn, rawaddr, addr)
+	case socksCmdUDPAssociate:
+		handleUDPAssociate(conn, rawaddr)
+	default:
+		sendReply(conn, socksRepCmdNotSupport, nil)
+	}
+}
+
+// sendReply writes a SOCKS5 reply (RFC 1928 section 6) with the given
+// reply code and bound address; a nil addr replies with 0.0.0.0:0.
+func sendReply(conn net.Conn, rep byte, addr net.Addr) error {
+	reply := []byte{socksVer5, rep, 0x00, 0x01, 0, 0, 0, 0, 0, 0}
+	if addr != nil {
+		ip, port := addrIPPort(addr)
+		if ip4 := ip.To4(); ip4 != nil {
+			copy(reply[4:8], ip4)
+		}
+		binary.BigEndian.PutUint16(reply[8:10], uint16(port))
+	}
+	_, err := conn.Write(reply)
+	return err
+}
+
+// addrIPPort extracts the IP and port from a *net.TCPAddr or *net.UDPAddr.
+func addrIPPort(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	default:
+		return nil, 0
+	}
+}
+
+func handleConnect(conn net.Conn, rawaddr []byte, addr string) {
+	if err := sendReply(conn, socksRepSucceeded, nil); err != nil {
 		debug.Println("send connection confirmation:", err)
 		return
 	}
-	remote, err := createServerConn(rawaddr, addr)
+	remote, idx, err := createServerConn(rawaddr, addr)
 	if err != nil {
 		debug.Println("connect to remote error: ", err)
 		return
 	}
-	defer func() {
-		if !closed {
-			remote.Close()
-		}
-	}()
-	go comm.PipeThenClose(conn, remote)
-	comm.PipeThenClose(remote, conn)
-	closed = true
+	defer remote.Close()
+	counted := &countingConn{Conn: remote, pool: server.pool, idx: idx}
+	go comm.PipeThenClose(conn, counted)
+	comm.PipeThenClose(counted, conn)
 	debug.Println("closed connection to", addr)
 }
 
@@ -204,17 +270,25 @@ type ServerCipher struct {
 }
 
 var server struct {
-	srvCipher ServerCipher
+	pool           *ServerPool
+	authenticators []Authenticator
+	transport      comm.Transport
 }
 
 func main() {
 	var configPath string
 	var version bool
+	var strategyFlag string
+	var managerFlag string
+	var rulesPath string
 	//var cmdConfig comm.Config
 
 	flag.BoolVar((*bool)(&debug), "d", false, "debug mode")
 	flag.BoolVar((*bool)(&version), "v", false, "current version")
 	flag.StringVar(&configPath, "c", os.Getenv("HOME")+"/.shadowsocks/config.json", "config path")
+	flag.StringVar(&strategyFlag, "s", "", "server selection strategy: round-robin, random, latency, failover")
+	flag.StringVar(&managerFlag, "manager", "", "manager UDP control address, e.g. 127.0.0.1:6001")
+	flag.StringVar(&rulesPath, "rules", "", "routing rules file (direct/reject by CIDR, domain, GeoIP); reloads on SIGHUP")
 	flag.Parse()
 
 	if version {
@@ -228,25 +302,53 @@ func main() {
 		log.Println(err)
 		os.Exit(1)
 	}
+	server.transport, err = comm.BuildTransport(config.Transport)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
 
 	if len(config.Servers) > 0 {
-		srv := config.Servers[0]
-		if srv.Password == "" || srv.Port == 0 {
-			log.Println("password or port cannot be empty")
-			os.Exit(1)
+		var servers []ServerCipher
+		for _, srv := range config.Servers {
+			if srv.Password == "" || srv.Port == 0 {
+				log.Println("password or port cannot be empty")
+				os.Exit(1)
+			}
+			if srv.Method == "" {
+				srv.Method = "chacha20-ietf-poly1305"
+			}
+			if err := comm.CheckCipherMethod(srv.Method); err != nil {
+				log.Println(err)
+				os.Exit(1)
+			}
+			servers = append(servers, ServerCipher{srv: srv, cipher: comm.NewCipher(srv)})
+		}
+		strategyName := config.Strategy
+		if strategyFlag != "" {
+			strategyName = strategyFlag
+		}
+		server.pool = NewServerPool(servers, strategyName)
+		if len(config.Users) > 0 {
+			// NoAuth is deliberately excluded here: offering it alongside
+			// UserPass would let a client skip credentials just by not
+			// advertising method 0x02.
+			server.authenticators = []Authenticator{NewUserPass(config.Users)}
+		} else {
+			server.authenticators = []Authenticator{NoAuth{}}
 		}
 
-		if srv.Method == "" {
-			srv.Method = "chacha20-ietf-poly1305"
+		managerAddr := config.ManagerAddress
+		if managerFlag != "" {
+			managerAddr = managerFlag
+		}
+		if managerAddr != "" {
+			go managerDaemon(managerAddr, server.pool)
 		}
 
-		err := comm.CheckCipherMethod(srv.Method)
-		if err != nil {
-			log.Println(err)
-			os.Exit(1)
+		if rulesPath != "" {
+			go watchRules(rulesPath)
 		}
-		server.srvCipher.srv = srv
-		server.srvCipher.cipher = comm.NewCipher(srv)
 		run(":" + strconv.Itoa(config.LocalPort))
 	} else {
 		log.Println("config file has some errors")
@@ -0,0 +1,50 @@
+package main
+
+import "strings"
+
+// domainTrie matches a host against a set of domain suffixes in O(labels)
+// by walking labels from the right (the TLD first), e.g. inserting
+// "example.com" matches "example.com" and "www.example.com" but not
+// "notexample.com".
+type domainTrie struct {
+	children map[string]*domainTrie
+	terminal bool
+}
+
+func newDomainTrie() *domainTrie {
+	return &domainTrie{children: make(map[string]*domainTrie)}
+}
+
+// Insert adds a suffix rule, e.g. "example.com" or "cn". Matching is
+// case-insensitive per RFC 4343, so suffix is lowercased before insertion.
+func (t *domainTrie) Insert(suffix string) {
+	labels := strings.Split(strings.Trim(strings.ToLower(suffix), "."), ".")
+	node := t
+	for i := len(labels) - 1; i >= 0; i-- {
+		label := labels[i]
+		child, ok := node.children[label]
+		if !ok {
+			child = newDomainTrie()
+			node.children[label] = child
+		}
+		node = child
+	}
+	node.terminal = true
+}
+
+// Match reports whether host ends in any inserted suffix, case-insensitively.
+func (t *domainTrie) Match(host string) bool {
+	labels := strings.Split(strings.Trim(strings.ToLower(host), "."), ".")
+	node := t
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := node.children[labels[i]]
+		if !ok {
+			return false
+		}
+		if child.terminal {
+			return true
+		}
+		node = child
+	}
+	return false
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestDomainTrieMatch(t *testing.T) {
+	trie := newDomainTrie()
+	trie.Insert("example.com")
+	trie.Insert("cn")
+
+	cases := []struct {
+		host string
+		want bool
+	}{
+		{"example.com", true},
+		{"www.example.com", true},
+		{"notexample.com", false},
+		{"example.com.evil.com", false},
+		{"baidu.cn", true},
+		{"example.org", false},
+		{"Example.COM", true},
+		{"WWW.EXAMPLE.COM", true},
+	}
+
+	for _, c := range cases {
+		if got := trie.Match(c.host); got != c.want {
+			t.Errorf("Match(%q) = %v, want %v", c.host, got, c.want)
+		}
+	}
+}
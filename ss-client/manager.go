@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	comm "github.com/go-shadowsocks/common"
+)
+
+const (
+	managerStatInterval = 10 * time.Second
+
+	managerCmdPingStop = "ping-stop"
+	managerCmdPing     = "ping"
+	managerCmdAdd      = "add:"
+	managerCmdRemove   = "remove:"
+)
+
+// managerAddCmd is the payload of a manager "add:" command.
+type managerAddCmd struct {
+	Server     string `json:"server"`
+	ServerPort int    `json:"server_port"`
+	Password   string `json:"password"`
+	Method     string `json:"method"`
+}
+
+// managerRemoveCmd is the payload of a manager "remove:" command.
+type managerRemoveCmd struct {
+	Server string `json:"server"`
+}
+
+// managerDaemon runs the ss-manager style UDP control protocol: newline
+// delimited text commands to add/remove upstream servers at runtime and to
+// register for periodic "stat:" traffic pushes.
+func managerDaemon(addr string, pool *ServerPool) {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		log.Println("manager: listen failed:", err)
+		return
+	}
+	defer pc.Close()
+	debug.Printf("manager: listening on %s\n", addr)
+
+	subs := newManagerSubs()
+	go subs.statLoop(pc, pool)
+
+	buf := make([]byte, 4096)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			debug.Println("manager: read failed:", err)
+			continue
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				handleManagerCommand(pc, from, line, pool, subs)
+			}
+		}
+	}
+}
+
+// handleManagerCommand dispatches one line of the manager protocol.
+// ping-stop is checked before ping since both start with "ping" and a
+// plain HasPrefix("ping") would otherwise swallow ping-stop too.
+func handleManagerCommand(pc net.PacketConn, from net.Addr, line string, pool *ServerPool, subs *managerSubs) {
+	switch {
+	case strings.HasPrefix(line, managerCmdPingStop):
+		subs.remove(from)
+	case strings.HasPrefix(line, managerCmdPing):
+		subs.add(from)
+		pc.WriteTo([]byte("pong"), from)
+	case strings.HasPrefix(line, managerCmdAdd):
+		var c managerAddCmd
+		body := strings.TrimSpace(line[len(managerCmdAdd):])
+		if err := json.Unmarshal([]byte(body), &c); err != nil {
+			debug.Println("manager: bad add command:", err)
+			return
+		}
+		srv := comm.Server{Server: c.Server, Port: c.ServerPort, Password: c.Password, Method: c.Method}
+		if err := pool.AddServer(srv); err != nil {
+			debug.Println("manager: add server failed:", err)
+		}
+	case strings.HasPrefix(line, managerCmdRemove):
+		var c managerRemoveCmd
+		body := strings.TrimSpace(line[len(managerCmdRemove):])
+		if err := json.Unmarshal([]byte(body), &c); err != nil {
+			debug.Println("manager: bad remove command:", err)
+			return
+		}
+		pool.RemoveServer(c.Server)
+	default:
+		debug.Println("manager: unknown command:", line)
+	}
+}
+
+// managerSubs is the set of peers registered via "ping" for periodic
+// "stat:" pushes, unregistered again via "ping-stop".
+type managerSubs struct {
+	mu   sync.Mutex
+	addr map[string]net.Addr
+}
+
+func newManagerSubs() *managerSubs {
+	return &managerSubs{addr: make(map[string]net.Addr)}
+}
+
+func (s *managerSubs) add(a net.Addr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addr[a.String()] = a
+}
+
+func (s *managerSubs) remove(a net.Addr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.addr, a.String())
+}
+
+func (s *managerSubs) list() []net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addrs := make([]net.Addr, 0, len(s.addr))
+	for _, a := range s.addr {
+		addrs = append(addrs, a)
+	}
+	return addrs
+}
+
+// statLoop periodically pushes each registered peer a "stat: {...}" line
+// with cumulative bytes transferred per server.
+func (s *managerSubs) statLoop(pc net.PacketConn, pool *ServerPool) {
+	ticker := time.NewTicker(managerStatInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		subs := s.list()
+		if len(subs) == 0 {
+			continue
+		}
+		payload, err := json.Marshal(pool.Stats())
+		if err != nil {
+			debug.Println("manager: marshal stats failed:", err)
+			continue
+		}
+		msg := append([]byte("stat: "), payload...)
+		for _, a := range subs {
+			pc.WriteTo(msg, a)
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	comm "github.com/go-shadowsocks/common"
+)
+
+// strategy picks which server in the pool a new connection should use.
+type strategy string
+
+const (
+	strategyRoundRobin strategy = "round-robin"
+	strategyRandom     strategy = "random"
+	strategyLatency    strategy = "latency"
+	strategyFailover   strategy = "failover"
+)
+
+const (
+	healthFailThreshold = 3
+	healthCooldown      = 30 * time.Second
+	latencyPingInterval = 10 * time.Second
+	latencyPingTimeout  = 3 * time.Second
+	latencyEWMAWeight   = 0.3
+)
+
+var errNoHealthyServer = errors.New("no healthy shadowsocks server available")
+
+// serverHealth is the circuit-breaker + latency state for one server in
+// the pool.
+type serverHealth struct {
+	mu               sync.Mutex
+	consecutiveFails int
+	cooldownUntil    time.Time
+	rtt              time.Duration
+}
+
+func (h *serverHealth) healthy() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return time.Now().After(h.cooldownUntil)
+}
+
+func (h *serverHealth) recordResult(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err == nil {
+		h.consecutiveFails = 0
+		h.cooldownUntil = time.Time{}
+		return
+	}
+	h.consecutiveFails++
+	if h.consecutiveFails >= healthFailThreshold {
+		h.cooldownUntil = time.Now().Add(healthCooldown)
+	}
+}
+
+func (h *serverHealth) recordRTT(rtt time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.rtt == 0 {
+		h.rtt = rtt
+		return
+	}
+	h.rtt = time.Duration(latencyEWMAWeight*float64(rtt) + (1-latencyEWMAWeight)*float64(h.rtt))
+}
+
+func (h *serverHealth) getRTT() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.rtt
+}
+
+// poolEntry is one server's cipher, circuit-breaker state, and traffic
+// counter, managed as a unit so the manager daemon can add/remove servers
+// at runtime without disturbing indices callers are mid-dial on. A removed
+// server leaves a nil tombstone in ServerPool.entries at its old index
+// rather than shifting every later entry down, so an idx captured from
+// Pick() before a removal (a long-lived UDP NAT entry, say) still points
+// nowhere near a different, still-live server.
+type poolEntry struct {
+	sc     ServerCipher
+	health *serverHealth
+	bytes  uint64
+}
+
+func (e *poolEntry) addr() string {
+	return net.JoinHostPort(e.sc.srv.Server, strconv.Itoa(e.sc.srv.Port))
+}
+
+// ServerPool holds every configured shadowsocks upstream and picks one per
+// connection according to the configured strategy, skipping servers whose
+// circuit breaker has tripped. Servers can be added or removed at runtime
+// (see the manager daemon).
+type ServerPool struct {
+	mu       sync.RWMutex
+	entries  []*poolEntry
+	strategy strategy
+	rrNext   uint32
+}
+
+// NewServerPool builds a pool from the configured servers, defaulting to
+// round-robin when strategy is empty or unrecognized.
+func NewServerPool(servers []ServerCipher, strategyName string) *ServerPool {
+	p := &ServerPool{strategy: strategy(strategyName)}
+	for _, sc := range servers {
+		p.entries = append(p.entries, &poolEntry{sc: sc, health: &serverHealth{}})
+	}
+	switch p.strategy {
+	case strategyRoundRobin, strategyRandom, strategyLatency, strategyFailover:
+	default:
+		p.strategy = strategyRoundRobin
+	}
+	if p.strategy == strategyLatency {
+		go p.pingLoop()
+	}
+	return p
+}
+
+// AddServer registers a new upstream, as used by the manager daemon's
+// "add" command. It is a no-op if the server is already present.
+func (p *ServerPool) AddServer(srv comm.Server) error {
+	if err := comm.CheckCipherMethod(srv.Method); err != nil {
+		return err
+	}
+	addr := net.JoinHostPort(srv.Server, strconv.Itoa(srv.Port))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, e := range p.entries {
+		if e != nil && e.addr() == addr {
+			return nil
+		}
+	}
+	sc := ServerCipher{srv: srv, cipher: comm.NewCipher(srv)}
+	p.entries = append(p.entries, &poolEntry{sc: sc, health: &serverHealth{}})
+	return nil
+}
+
+// RemoveServer unregisters the first upstream whose server host equals
+// host (the port is not compared), as used by the manager daemon's
+// "remove" command; other entries with the same host stay in the pool. It
+// reports whether a server was actually removed. The entry's slot is left as a nil tombstone instead of
+// being compacted out, so indices already handed out by Pick stay valid.
+func (p *ServerPool) RemoveServer(host string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, e := range p.entries {
+		if e != nil && e.sc.srv.Server == host {
+			p.entries[i] = nil
+			return true
+		}
+	}
+	return false
+}
+
+// AddBytes accumulates traffic for the server at idx, reported by the
+// manager daemon's periodic "stat" push.
+func (p *ServerPool) AddBytes(idx int, n int64) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if idx < 0 || idx >= len(p.entries) || p.entries[idx] == nil {
+		return
+	}
+	atomic.AddUint64(&p.entries[idx].bytes, uint64(n))
+}
+
+// Stats returns cumulative bytes transferred per server, keyed by
+// "host:port", for the manager daemon's "stat" push.
+func (p *ServerPool) Stats() map[string]uint64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	stats := make(map[string]uint64, len(p.entries))
+	for _, e := range p.entries {
+		if e == nil {
+			continue
+		}
+		stats[e.addr()] = atomic.LoadUint64(&e.bytes)
+	}
+	return stats
+}
+
+// Pick selects a server to dial for one connection, returning its index so
+// the caller can report the dial outcome back via RecordResult and its
+// traffic back via AddBytes.
+func (p *ServerPool) Pick() (*ServerCipher, int, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(p.entries) == 0 {
+		return nil, -1, errNoHealthyServer
+	}
+	switch p.strategy {
+	case strategyRandom:
+		return p.pickRandom()
+	case strategyLatency:
+		return p.pickLatency()
+	case strategyFailover:
+		return p.pickFailover()
+	default:
+		return p.pickRoundRobin()
+	}
+}
+
+// RecordResult feeds a dial outcome back into a server's circuit breaker.
+func (p *ServerPool) RecordResult(idx int, err error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if idx < 0 || idx >= len(p.entries) || p.entries[idx] == nil {
+		return
+	}
+	p.entries[idx].health.recordResult(err)
+}
+
+// callers must hold p.mu (for reading) before calling the pick* helpers.
+// Tombstoned (nil) entries left behind by RemoveServer are skipped.
+
+func (p *ServerPool) pickRoundRobin() (*ServerCipher, int, error) {
+	n := len(p.entries)
+	start := int(atomic.AddUint32(&p.rrNext, 1)-1) % n
+	for i := 0; i < n; i++ {
+		idx := (start + i) % n
+		e := p.entries[idx]
+		if e != nil && e.health.healthy() {
+			return &e.sc, idx, nil
+		}
+	}
+	return nil, -1, errNoHealthyServer
+}
+
+func (p *ServerPool) pickRandom() (*ServerCipher, int, error) {
+	n := len(p.entries)
+	start := rand.Intn(n)
+	for i := 0; i < n; i++ {
+		idx := (start + i) % n
+		e := p.entries[idx]
+		if e != nil && e.health.healthy() {
+			return &e.sc, idx, nil
+		}
+	}
+	return nil, -1, errNoHealthyServer
+}
+
+// pickFailover sticks to the first healthy server in configuration order.
+func (p *ServerPool) pickFailover() (*ServerCipher, int, error) {
+	for idx, e := range p.entries {
+		if e != nil && e.health.healthy() {
+			return &e.sc, idx, nil
+		}
+	}
+	return nil, -1, errNoHealthyServer
+}
+
+// pickLatency prefers the healthy server with the lowest smoothed RTT,
+// falling back to failover order for servers with no RTT sample yet.
+func (p *ServerPool) pickLatency() (*ServerCipher, int, error) {
+	best := -1
+	var bestRTT time.Duration
+	for idx, e := range p.entries {
+		if e == nil || !e.health.healthy() {
+			continue
+		}
+		rtt := e.health.getRTT()
+		if best == -1 || (rtt > 0 && (bestRTT == 0 || rtt < bestRTT)) {
+			best, bestRTT = idx, rtt
+		}
+	}
+	if best == -1 {
+		return nil, -1, errNoHealthyServer
+	}
+	return &p.entries[best].sc, best, nil
+}
+
+// pingLoop periodically TCP-pings every server to keep RTT estimates fresh
+// for the latency strategy.
+func (p *ServerPool) pingLoop() {
+	ticker := time.NewTicker(latencyPingInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		p.mu.RLock()
+		entries := append([]*poolEntry(nil), p.entries...)
+		p.mu.RUnlock()
+		for _, e := range entries {
+			if e == nil {
+				continue
+			}
+			go p.pingOne(e)
+		}
+	}
+}
+
+// countingConn wraps a remote connection so traffic relayed through it is
+// accounted to its server in the pool, for the manager daemon's periodic
+// stat push.
+type countingConn struct {
+	*comm.Conn
+	pool *ServerPool
+	idx  int
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.pool.AddBytes(c.idx, int64(n))
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.pool.AddBytes(c.idx, int64(n))
+	}
+	return n, err
+}
+
+func (p *ServerPool) pingOne(e *poolEntry) {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", e.addr(), latencyPingTimeout)
+	if err != nil {
+		e.health.recordResult(err)
+		return
+	}
+	conn.Close()
+	e.health.recordRTT(time.Since(start))
+}
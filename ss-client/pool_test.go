@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+
+	comm "github.com/go-shadowsocks/common"
+)
+
+func testServers(n int) []ServerCipher {
+	servers := make([]ServerCipher, n)
+	for i := range servers {
+		srv := comm.Server{Server: "127.0.0.1", Port: 9000 + i, Method: "chacha20-ietf-poly1305", Password: "pw"}
+		servers[i] = ServerCipher{srv: srv, cipher: comm.NewCipher(srv)}
+	}
+	return servers
+}
+
+func TestServerPoolRemoveKeepsIndicesStable(t *testing.T) {
+	pool := NewServerPool(testServers(3), "failover")
+
+	_, idx2, err := pool.Pick()
+	if err != nil {
+		t.Fatalf("Pick() error: %v", err)
+	}
+	if idx2 != 0 {
+		t.Fatalf("Pick() returned idx %d, want 0 (failover picks the first healthy entry)", idx2)
+	}
+
+	if !pool.RemoveServer("127.0.0.1") {
+		t.Fatal("RemoveServer() = false, want true")
+	}
+
+	// A pending RecordResult/AddBytes for a now-removed entry must not be
+	// silently redirected onto whatever server happens to have slid into
+	// its old slot.
+	pool.AddBytes(0, 100)
+	stats := pool.Stats()
+	if len(stats) != 2 {
+		t.Fatalf("Stats() returned %d servers, want 2 (one removed)", len(stats))
+	}
+	for addr, b := range stats {
+		if b != 0 {
+			t.Fatalf("Stats()[%s] = %d, want 0 (bytes for the removed index were redirected)", addr, b)
+		}
+	}
+
+	// The remaining two servers must still be reachable at their original
+	// indices (1 and 2), not shifted down to (0 and 1).
+	_, idx, err := pool.Pick()
+	if err != nil {
+		t.Fatalf("Pick() after remove: %v", err)
+	}
+	if idx == 0 {
+		t.Fatal("Pick() after remove returned the tombstoned index 0")
+	}
+}
+
+func TestServerPoolAddServerDedups(t *testing.T) {
+	pool := NewServerPool(testServers(1), "failover")
+	srv := comm.Server{Server: "127.0.0.1", Port: 9000, Method: "chacha20-ietf-poly1305", Password: "pw"}
+	if err := pool.AddServer(srv); err != nil {
+		t.Fatalf("AddServer() error: %v", err)
+	}
+	if len(pool.Stats()) != 1 {
+		t.Fatalf("AddServer() duplicated an existing server: %d entries", len(pool.Stats()))
+	}
+
+	other := comm.Server{Server: "127.0.0.2", Port: 9001, Method: "chacha20-ietf-poly1305", Password: "pw"}
+	if err := pool.AddServer(other); err != nil {
+		t.Fatalf("AddServer() error: %v", err)
+	}
+	if len(pool.Stats()) != 2 {
+		t.Fatalf("AddServer() did not add new server: %d entries", len(pool.Stats()))
+	}
+}
+
+func TestServerPoolPickNoHealthyServer(t *testing.T) {
+	pool := NewServerPool(nil, "failover")
+	if _, _, err := pool.Pick(); err != errNoHealthyServer {
+		t.Fatalf("Pick() on empty pool = %v, want errNoHealthyServer", err)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+
+	comm "github.com/go-shadowsocks/common"
+)
+
+// rules holds the active RuleSet, swapped atomically on SIGHUP so
+// in-flight connections never see a half-loaded ruleset.
+var rules atomic.Value // holds *RuleSet
+
+func currentRules() *RuleSet {
+	rs, _ := rules.Load().(*RuleSet)
+	return rs
+}
+
+// watchRules loads rules.yaml and reloads it on SIGHUP for as long as the
+// process runs.
+func watchRules(path string) {
+	if err := reloadRules(path); err != nil {
+		log.Println("rules: initial load failed:", err)
+	}
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	for range sighup {
+		if err := reloadRules(path); err != nil {
+			log.Println("rules: reload failed, keeping previous ruleset:", err)
+			continue
+		}
+		debug.Println("rules: reloaded", path)
+	}
+}
+
+func reloadRules(path string) error {
+	rs, err := LoadRuleSet(path)
+	if err != nil {
+		return err
+	}
+	if old := currentRules(); old != nil {
+		old.Close()
+	}
+	rules.Store(rs)
+	return nil
+}
+
+// decideRoute inspects a parsed CONNECT request's destination and decides
+// whether it should be dialed directly, proxied through shadowsocks, or
+// rejected, per the active RuleSet.
+func decideRoute(rawaddr []byte, host string) routeAction {
+	rs := currentRules()
+	if rs == nil {
+		return routeProxy
+	}
+	rs.acquire()
+	defer rs.release()
+	hostname, _, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname = host
+	}
+	switch rawaddr[0] {
+	case typeIPv4, typeIPv6:
+		ip := net.IP(rawaddr[1 : len(rawaddr)-2])
+		return rs.DecideIP(ip)
+	default: // typeDm
+		return rs.Decide(hostname)
+	}
+}
+
+// handleDirect dials the destination locally (bypassing the shadowsocks
+// tunnel) and pipes the client straight through, for rules.yaml "direct"
+// matches such as LAN addresses or bypassed domains.
+func handleDirect(conn net.Conn, addr string) {
+	if err := sendReply(conn, socksRepSucceeded, nil); err != nil {
+		debug.Println("direct: send connection confirmation:", err)
+		return
+	}
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		debug.Println("direct: dial failed:", err)
+		return
+	}
+	defer target.Close()
+	go comm.PipeThenClose(conn, target)
+	comm.PipeThenClose(target, conn)
+	debug.Println("direct: closed connection to", addr)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+
+	maxminddb "github.com/oschwald/maxminddb-golang"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// routeAction is the outcome of matching a destination against the
+// RuleSet: dial it directly, send it through the shadowsocks server, or
+// refuse it outright.
+type routeAction int
+
+const (
+	routeProxy routeAction = iota
+	routeDirect
+	routeReject
+)
+
+// ruleGroupConfig is one "direct:" or "reject:" block of rules.yaml.
+type ruleGroupConfig struct {
+	CIDRs    []string `yaml:"cidrs"`
+	Suffixes []string `yaml:"suffixes"`
+	Keywords []string `yaml:"keywords"`
+}
+
+// rulesConfig is the on-disk shape of rules.yaml.
+type rulesConfig struct {
+	Direct ruleGroupConfig `yaml:"direct"`
+	Reject ruleGroupConfig `yaml:"reject"`
+	GeoIP  struct {
+		Database        string   `yaml:"database"`
+		DirectCountries []string `yaml:"direct_countries"`
+	} `yaml:"geoip"`
+}
+
+// ruleGroup is a ruleGroupConfig compiled into matchable structures.
+type ruleGroup struct {
+	cidrs    *cidrList
+	suffixes *domainTrie
+	keywords []string
+}
+
+func compileRuleGroup(cfg ruleGroupConfig) (*ruleGroup, error) {
+	cidrs, err := newCIDRList(cfg.CIDRs)
+	if err != nil {
+		return nil, err
+	}
+	trie := newDomainTrie()
+	for _, s := range cfg.Suffixes {
+		trie.Insert(s)
+	}
+	keywords := make([]string, len(cfg.Keywords))
+	for i, kw := range cfg.Keywords {
+		keywords[i] = strings.ToLower(kw)
+	}
+	return &ruleGroup{cidrs: cidrs, suffixes: trie, keywords: keywords}, nil
+}
+
+// matchesHost reports whether host matches this group's suffixes or
+// keywords. Matching is case-insensitive per RFC 4343, since domain names
+// are not case-sensitive.
+func (g *ruleGroup) matchesHost(host string) bool {
+	if g.suffixes.Match(host) {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, kw := range g.keywords {
+		if strings.Contains(host, kw) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *ruleGroup) matchesIP(ip netip.Addr) bool {
+	return g.cidrs.Contains(ip)
+}
+
+// lanDefaultCIDRs are always added to the direct group: loopback, the
+// RFC 1918 private ranges, and the IPv6 loopback and unique-local ranges.
+// A reject rule in rules.yaml that matches them still takes precedence.
+var lanDefaultCIDRs = []string{
+	"127.0.0.0/8",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::1/128",
+	"fc00::/7",
+}
+
+// cnSeedCIDRs is a small, representative seed of China-allocated ranges
+// for the "bypass CN" default; it is not exhaustive. Deployments that need
+// full coverage should list a complete CIDR set (or a GeoIP database)
+// under direct.cidrs / geoip in rules.yaml.
+var cnSeedCIDRs = []string{
+	"1.0.1.0/24",
+	"1.0.2.0/23",
+	"14.0.0.0/8",
+	"27.0.0.0/8",
+	"36.0.0.0/8",
+	"42.0.0.0/8",
+	"58.0.0.0/7",
+	"60.0.0.0/8",
+	"101.0.0.0/8",
+	"103.0.0.0/9",
+	"106.0.0.0/8",
+	"110.0.0.0/7",
+	"112.0.0.0/5",
+	"120.0.0.0/6",
+	"124.0.0.0/7",
+	"175.0.0.0/8",
+	"183.0.0.0/8",
+	"202.0.0.0/8",
+	"210.0.0.0/8",
+	"211.0.0.0/8",
+	"218.0.0.0/7",
+	"220.0.0.0/6",
+	"222.0.0.0/8",
+	"223.0.0.0/8",
+}
+
+// RuleSet decides, for one destination, whether to dial direct, proxy
+// through the shadowsocks server, or reject the connection outright.
+// Reject rules take precedence over direct rules so ad-block lists can
+// override a broader bypass rule.
+//
+// mu/refs/closed implement a grace-period teardown: a SIGHUP reload swaps
+// the active *RuleSet out from under in-flight decideRoute/DecideIP calls,
+// but those calls may still be mid-Lookup against geoDB, so Close only
+// unmaps it once every acquirer that was handed this RuleSet has released
+// it, instead of closing it out from under them.
+type RuleSet struct {
+	direct      *ruleGroup
+	reject      *ruleGroup
+	geoDB       *maxminddb.Reader
+	geoDirectCC map[string]bool
+
+	mu     sync.Mutex
+	refs   int
+	closed bool
+}
+
+// LoadRuleSet reads and compiles rules.yaml at path. The LAN defaults and
+// a seed China CIDR list are always folded into the "direct" group.
+func LoadRuleSet(path string) (*RuleSet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg rulesConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	cfg.Direct.CIDRs = append(append([]string{}, lanDefaultCIDRs...), append(cnSeedCIDRs, cfg.Direct.CIDRs...)...)
+
+	direct, err := compileRuleGroup(cfg.Direct)
+	if err != nil {
+		return nil, err
+	}
+	reject, err := compileRuleGroup(cfg.Reject)
+	if err != nil {
+		return nil, err
+	}
+
+	rs := &RuleSet{direct: direct, reject: reject}
+	if cfg.GeoIP.Database != "" {
+		db, err := maxminddb.Open(cfg.GeoIP.Database)
+		if err != nil {
+			return nil, err
+		}
+		rs.geoDB = db
+		rs.geoDirectCC = make(map[string]bool, len(cfg.GeoIP.DirectCountries))
+		for _, cc := range cfg.GeoIP.DirectCountries {
+			rs.geoDirectCC[strings.ToUpper(cc)] = true
+		}
+	}
+	return rs, nil
+}
+
+// Decide routes a domain-name destination.
+func (rs *RuleSet) Decide(host string) routeAction {
+	if rs == nil {
+		return routeProxy
+	}
+	if rs.reject.matchesHost(host) {
+		return routeReject
+	}
+	if rs.direct.matchesHost(host) {
+		return routeDirect
+	}
+	return routeProxy
+}
+
+// DecideIP routes an IP-literal destination, additionally consulting the
+// GeoIP database if one was configured.
+func (rs *RuleSet) DecideIP(ip net.IP) routeAction {
+	if rs == nil {
+		return routeProxy
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return routeProxy
+	}
+	addr = addr.Unmap()
+	if rs.reject.matchesIP(addr) {
+		return routeReject
+	}
+	if rs.direct.matchesIP(addr) {
+		return routeDirect
+	}
+	if rs.geoDB != nil {
+		var record struct {
+			Country struct {
+				ISOCode string `maxminddb:"iso_code"`
+			} `maxminddb:"country"`
+		}
+		if err := rs.geoDB.Lookup(ip, &record); err == nil {
+			if rs.geoDirectCC[strings.ToUpper(record.Country.ISOCode)] {
+				return routeDirect
+			}
+		}
+	}
+	return routeProxy
+}
+
+// acquire marks rs as in use by one more in-flight lookup, so Close (and
+// the GeoIP mmap unmap it performs) waits for release before tearing it
+// down.
+func (rs *RuleSet) acquire() {
+	if rs == nil {
+		return
+	}
+	rs.mu.Lock()
+	rs.refs++
+	rs.mu.Unlock()
+}
+
+// release drops the reference taken by acquire, closing the GeoIP
+// database if Close was already requested and this was the last acquirer.
+func (rs *RuleSet) release() {
+	if rs == nil {
+		return
+	}
+	rs.mu.Lock()
+	rs.refs--
+	closeNow := rs.closed && rs.refs == 0
+	rs.mu.Unlock()
+	if closeNow {
+		rs.closeGeoDB()
+	}
+}
+
+// Close requests teardown of rs, releasing the GeoIP database once every
+// lookup that had already acquired rs has released it.
+func (rs *RuleSet) Close() error {
+	if rs == nil {
+		return nil
+	}
+	rs.mu.Lock()
+	rs.closed = true
+	closeNow := rs.refs == 0
+	rs.mu.Unlock()
+	if closeNow {
+		return rs.closeGeoDB()
+	}
+	return nil
+}
+
+func (rs *RuleSet) closeGeoDB() error {
+	if rs.geoDB == nil {
+		return nil
+	}
+	return rs.geoDB.Close()
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	comm "github.com/go-shadowsocks/common"
+)
+
+const udpNATIdleTimeout = 5 * time.Minute
+
+// udpNATEntry is one client-source-addr's path to the shadowsocks server:
+// the encrypted UDP "connection" used to relay its datagrams, plus a
+// last-seen timestamp for idle eviction.
+type udpNATEntry struct {
+	remote   *comm.UDPConn
+	srvIdx   int
+	lastSeen time.Time
+}
+
+// udpNAT demultiplexes one local relay socket's inbound datagrams by the
+// application's source address, so each gets its own encrypted path to the
+// shadowsocks server.
+type udpNAT struct {
+	mu      sync.Mutex
+	entries map[string]*udpNATEntry
+}
+
+func newUDPNAT() *udpNAT {
+	return &udpNAT{entries: make(map[string]*udpNATEntry)}
+}
+
+func (t *udpNAT) get(clientAddr string) (*udpNATEntry, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.entries[clientAddr]
+	if ok {
+		e.lastSeen = time.Now()
+	}
+	return e, ok
+}
+
+func (t *udpNAT) put(clientAddr string, e *udpNATEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries[clientAddr] = e
+}
+
+// sweep drops entries idle for longer than udpNATIdleTimeout and closes
+// their remote connections.
+func (t *udpNAT) sweep() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	for addr, e := range t.entries {
+		if now.Sub(e.lastSeen) > udpNATIdleTimeout {
+			e.remote.Close()
+			delete(t.entries, addr)
+		}
+	}
+}
+
+// closeAll closes every remaining entry's remote connection and empties
+// the table. Called on association teardown, since sweep's idle ticker is
+// stopped at the same time and would otherwise never reclaim entries that
+// were still alive when the control connection closed.
+func (t *udpNAT) closeAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for addr, e := range t.entries {
+		e.remote.Close()
+		delete(t.entries, addr)
+	}
+}
+
+// handleUDPAssociate implements the SOCKS5 UDP ASSOCIATE command (RFC 1928
+// section 4 / 7). We open a local relay socket, tell the client where it
+// is, then for as long as the TCP control connection stays open we shuttle
+// datagrams between the client and the shadowsocks server. Each client
+// datagram's SOCKS5 UDP header (RSV(2)+FRAG+ATYP+DST.ADDR+DST.PORT) loses
+// RSV and FRAG, and ATYP+DST.ADDR+DST.PORT plus the payload is sent
+// encrypted; replies get the header put back by relayUDPReplies.
+func handleUDPAssociate(conn net.Conn, rawaddr []byte) {
+	pc, err := comm.ListenPacket(":0")
+	if err != nil {
+		debug.Println("udp associate: listen failed:", err)
+		sendReply(conn, socksRepCmdNotSupport, nil)
+		return
+	}
+	defer pc.Close()
+
+	if err := sendReply(conn, socksRepSucceeded, pc.LocalAddr().(*net.UDPAddr)); err != nil {
+		debug.Println("udp associate: send reply:", err)
+		return
+	}
+
+	nat := newUDPNAT()
+	ticker := time.NewTicker(udpNATIdleTimeout)
+	defer ticker.Stop()
+	done := make(chan struct{})
+
+	// Tear the association down once the TCP control connection closes,
+	// per RFC 1928's requirement that UDP ASSOCIATE's lifetime tracks it.
+	// Any bytes the client sends on the control connection are discarded
+	// and not treated as closure; only Read actually returning an error
+	// (EOF included) means the connection is gone. The read deadline that
+	// getRequest set is cleared first so it cannot end the association.
+	go func() {
+		conn.SetReadDeadline(time.Time{})
+		buf := make([]byte, 1)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				break
+			}
+		}
+		close(done)
+		pc.Close()
+		nat.closeAll()
+	}()
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				nat.sweep()
+			}
+		}
+	}()
+
+	buf := make([]byte, 65536)
+	for {
+		n, clientAddr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if n < 4 {
+			continue
+		}
+		if buf[2] != 0 { // FRAG != 0: fragmented datagrams are not supported
+			debug.Println("udp associate: dropping fragmented packet")
+			continue
+		}
+
+		rawHeader, headerLen, err := parseUDPHeader(buf[3:n])
+		if err != nil {
+			debug.Println("udp associate: bad header:", err)
+			continue
+		}
+		dstAddr := append([]byte(nil), rawHeader...) // own copy: buf gets reused next ReadFrom
+		payload := buf[3+headerLen : n]
+
+		entry, ok := nat.get(clientAddr.String())
+		if !ok {
+			sc, idx, err := server.pool.Pick()
+			if err != nil {
+				debug.Println("udp associate: no server available:", err)
+				continue
+			}
+			serverport := sc.srv.Server + ":" + strconv.Itoa(sc.srv.Port)
+			remote, err := comm.DialUDPWithRawAddr(serverport, sc.cipher)
+			server.pool.RecordResult(idx, err)
+			if err != nil {
+				debug.Println("udp associate: dial remote failed:", err)
+				continue
+			}
+			entry = &udpNATEntry{remote: remote, srvIdx: idx, lastSeen: time.Now()}
+			nat.put(clientAddr.String(), entry)
+			go relayUDPReplies(pc, clientAddr, entry, dstAddr)
+		}
+
+		packet := make([]byte, 0, len(dstAddr)+len(payload))
+		packet = append(packet, dstAddr...)
+		packet = append(packet, payload...)
+		if _, err := entry.remote.Write(packet); err != nil {
+			debug.Println("udp associate: relay to remote failed:", err)
+		} else {
+			server.pool.AddBytes(entry.srvIdx, int64(len(packet)))
+		}
+	}
+}
+
+// relayUDPReplies copies datagrams coming back from the shadowsocks server
+// to the client, re-attaching the SOCKS5 UDP header.
+func relayUDPReplies(pc *comm.PacketConn, clientAddr net.Addr, entry *udpNATEntry, dstAddr []byte) {
+	buf := make([]byte, 65536)
+	header := append([]byte{0, 0, 0}, dstAddr...)
+	for {
+		n, err := entry.remote.Read(buf)
+		if err != nil {
+			return
+		}
+		server.pool.AddBytes(entry.srvIdx, int64(n))
+		pc.WriteTo(append(header, buf[:n]...), clientAddr)
+	}
+}
+
+// parseUDPHeader parses the ATYP+DST.ADDR+DST.PORT portion of a SOCKS5 UDP
+// request, returning it unparsed (ready to reuse as the rawaddr shadowsocks
+// expects) along with its length.
+func parseUDPHeader(buf []byte) (rawaddr []byte, n int, err error) {
+	if len(buf) < 1 {
+		return nil, 0, errReqExtraData
+	}
+	switch buf[0] {
+	case 1: // IPv4
+		n = 1 + net.IPv4len + 2
+	case 4: // IPv6
+		n = 1 + net.IPv6len + 2
+	case 3: // domain name
+		if len(buf) < 2 {
+			return nil, 0, errReqExtraData
+		}
+		n = 1 + 1 + int(buf[1]) + 2
+	default:
+		return nil, 0, errAddrType
+	}
+	if len(buf) < n {
+		return nil, 0, errReqExtraData
+	}
+	return buf[:n], n, nil
+}